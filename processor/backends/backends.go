@@ -0,0 +1,67 @@
+// Package backends ships additional Instrumenter implementations on top of the
+// processor's default OpenTelemetry output, registered by name via
+// processor.RegisterInstrumenter so callers can select one by config or CLI flag.
+package backends
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+
+	"github.com/jfallis/go-instrument/processor"
+)
+
+// parseStmts parses src as the body of a throwaway function and returns its
+// statement list, which lets each backend write its injected code as plain Go source
+// instead of constructing the ast by hand.
+func parseStmts(src string) ([]ast.Stmt, error) {
+	fset := token.NewFileSet()
+
+	f, err := parser.ParseFile(fset, "", "package p\nfunc _() {\n"+src+"\n}", parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("backends: parse statements: %w", err)
+	}
+
+	return f.Decls[0].(*ast.FuncDecl).Body.List, nil
+}
+
+// sortedKeys returns attrs' keys in sorted order, so backends emit attribute
+// statements in a deterministic order regardless of map iteration order.
+func sortedKeys(attrs map[string]string) []string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// captureValue returns the Go expression source for a Capture's value. Redacted
+// captures emit a literal. String and numeric captures are passed through as the
+// bare identifier — SetTag/slog.Info accept them with their native type directly,
+// so there's no typed constructor to call into beyond that — except that a string
+// capture with MaxStringLen set is wrapped in a length-capping conversion first.
+// Every other kind (structs, pointers, interfaces, slices, maps, ...) has no native
+// representation the backends can use, so it falls back to fmt.Sprintf("%v", v).
+func captureValue(c processor.Capture) string {
+	if c.Redact {
+		return `"<redacted>"`
+	}
+
+	switch c.Type {
+	case "string":
+		if c.MaxStringLen > 0 {
+			return fmt.Sprintf(`func(v string) string { if len(v) > %d { return v[:%d] }; return v }(%s)`,
+				c.MaxStringLen, c.MaxStringLen, c.Name)
+		}
+
+		return c.Name
+	case "numeric":
+		return c.Name
+	default:
+		return fmt.Sprintf(`fmt.Sprintf("%%v", %s)`, c.Name)
+	}
+}
@@ -0,0 +1,97 @@
+package backends
+
+import (
+	"fmt"
+	"go/ast"
+	"strings"
+
+	"github.com/jfallis/go-instrument/processor"
+)
+
+func init() {
+	processor.RegisterInstrumenter("opentracing", newOpenTracing)
+}
+
+// OpenTracing emits opentracing.StartSpanFromContext/Finish pairs instead of the
+// OpenTelemetry calls the default Instrumenter produces, for shops still on the
+// OpenTracing API.
+type OpenTracing struct {
+	ErrorName string
+}
+
+func newOpenTracing(cfg map[string]any) (processor.Instrumenter, error) {
+	errName, _ := cfg["error_name"].(string)
+	if errName == "" {
+		errName = "err"
+	}
+
+	return &OpenTracing{ErrorName: errName}, nil
+}
+
+func (o *OpenTracing) Imports() []string {
+	return []string{"github.com/opentracing/opentracing-go"}
+}
+
+func (o *OpenTracing) OwnedImports() []string {
+	return o.Imports()
+}
+
+func (o *OpenTracing) PrefixStatements(spanName string, hasError bool, attrs map[string]string) []ast.Stmt {
+	stmts, err := parseStmts(o.source(spanName, "ctx", hasError, attrs))
+	if err != nil {
+		return nil
+	}
+
+	return stmts
+}
+
+func (o *OpenTracing) PrefixStatementsForClosure(spanName, parentCtxIdent string, hasError bool) []ast.Stmt {
+	stmts, err := parseStmts(o.source(spanName, parentCtxIdent, hasError, nil))
+	if err != nil {
+		return nil
+	}
+
+	return stmts
+}
+
+func (o *OpenTracing) AttributeStatements(spanVar string, captures []processor.Capture) []ast.Stmt {
+	var immediate, deferred []string
+	for _, c := range captures {
+		line := fmt.Sprintf("%s.SetTag(%q, %s)", spanVar, c.Name, captureValue(c))
+		if c.Kind == "result" {
+			deferred = append(deferred, line)
+		} else {
+			immediate = append(immediate, line)
+		}
+	}
+
+	src := strings.Join(immediate, "\n")
+	if len(deferred) > 0 {
+		if src != "" {
+			src += "\n"
+		}
+		src += "defer func() {\n" + strings.Join(deferred, "\n") + "\n}()"
+	}
+
+	stmts, err := parseStmts(src)
+	if err != nil {
+		return nil
+	}
+
+	return stmts
+}
+
+func (o *OpenTracing) source(spanName, ctxIdent string, hasError bool, attrs map[string]string) string {
+	src := fmt.Sprintf("span, %s := opentracing.StartSpanFromContext(%s, %q)\ndefer span.Finish()",
+		ctxIdent, ctxIdent, spanName)
+
+	for _, key := range sortedKeys(attrs) {
+		src += fmt.Sprintf("\nspan.SetTag(%q, %q)", key, attrs[key])
+	}
+
+	if hasError {
+		src += fmt.Sprintf("\ndefer func() {\n\tif %s != nil {\n\t\tspan.SetTag(\"error\", true)\n\t}\n}()", o.ErrorName)
+	}
+
+	return src
+}
@@ -0,0 +1,125 @@
+package backends
+
+import (
+	"fmt"
+	"go/ast"
+	"strings"
+
+	"github.com/jfallis/go-instrument/processor"
+)
+
+func init() {
+	processor.RegisterInstrumenter("slog", newSlog)
+}
+
+// Slog emits structured slog.InfoContext enter/exit log lines with duration instead of
+// creating a tracing span, for shops that want instrumentation without a tracer.
+type Slog struct {
+	ErrorName string
+}
+
+func newSlog(cfg map[string]any) (processor.Instrumenter, error) {
+	errName, _ := cfg["error_name"].(string)
+	if errName == "" {
+		errName = "err"
+	}
+
+	return &Slog{ErrorName: errName}, nil
+}
+
+func (s *Slog) Imports() []string {
+	return []string{"log/slog", "time"}
+}
+
+func (s *Slog) OwnedImports() []string {
+	return s.Imports()
+}
+
+func (s *Slog) PrefixStatements(spanName string, hasError bool, attrs map[string]string) []ast.Stmt {
+	stmts, err := parseStmts(s.source(spanName, "ctx", hasError, attrs))
+	if err != nil {
+		return nil
+	}
+
+	return stmts
+}
+
+func (s *Slog) PrefixStatementsForClosure(spanName, parentCtxIdent string, hasError bool) []ast.Stmt {
+	stmts, err := parseStmts(s.source(spanName, parentCtxIdent, hasError, nil))
+	if err != nil {
+		return nil
+	}
+
+	return stmts
+}
+
+// AttributeStatements logs each capture as its own slog key/value pair. Slog has no
+// span object to attach attributes to, so spanVar is unused; result captures are
+// logged from a defer instead so they observe the function's return values.
+func (s *Slog) AttributeStatements(spanVar string, captures []processor.Capture) []ast.Stmt {
+	_ = spanVar
+
+	var immediate, deferred []string
+	for _, c := range captures {
+		line := fmt.Sprintf("slog.Info(\"attr\", %q, %s)", c.Name, captureValue(c))
+		if c.Kind == "result" {
+			deferred = append(deferred, line)
+		} else {
+			immediate = append(immediate, line)
+		}
+	}
+
+	src := strings.Join(immediate, "\n")
+	if len(deferred) > 0 {
+		if src != "" {
+			src += "\n"
+		}
+		src += "defer func() {\n" + strings.Join(deferred, "\n") + "\n}()"
+	}
+
+	stmts, err := parseStmts(src)
+	if err != nil {
+		return nil
+	}
+
+	return stmts
+}
+
+func (s *Slog) source(spanName, ctxIdent string, hasError bool, attrs map[string]string) string {
+	start := fmt.Sprintf("__start%s", sanitize(spanName))
+
+	enter := fmt.Sprintf("slog.InfoContext(%s, \"enter\", \"span\", %q", ctxIdent, spanName)
+	for _, key := range sortedKeys(attrs) {
+		enter += fmt.Sprintf(", %q, %q", key, attrs[key])
+	}
+	enter += ")"
+
+	src := fmt.Sprintf("%s\n%s := time.Now()", enter, start)
+
+	if hasError {
+		src += fmt.Sprintf("\ndefer func() {\n\tslog.InfoContext(%s, \"exit\", \"span\", %q, \"duration\", time.Since(%s), \"error\", %s)\n}()",
+			ctxIdent, spanName, start, s.ErrorName)
+	} else {
+		src += fmt.Sprintf("\ndefer func() {\n\tslog.InfoContext(%s, \"exit\", \"span\", %q, \"duration\", time.Since(%s))\n}()",
+			ctxIdent, spanName, start)
+	}
+
+	return src
+}
+
+// sanitize turns a span name into a legal Go identifier suffix so each instrumented
+// function gets its own __start variable instead of colliding on a shared name.
+func sanitize(spanName string) string {
+	b := make([]byte, 0, len(spanName))
+	for i := 0; i < len(spanName); i++ {
+		c := spanName[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			b = append(b, c)
+		default:
+			b = append(b, '_')
+		}
+	}
+
+	return string(b)
+}
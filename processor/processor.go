@@ -1,8 +1,14 @@
 package processor
 
 import (
+	"fmt"
 	"go/ast"
+	"go/build"
 	"go/token"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"golang.org/x/tools/go/ast/astutil"
@@ -11,7 +17,21 @@ import (
 // Instrumenter supplies ast of Go code that will be inserted and required dependencies.
 type Instrumenter interface {
 	Imports() []string
-	PrefixStatements(spanName string, hasError bool) []ast.Stmt
+	PrefixStatements(spanName string, hasError bool, attrs map[string]string) []ast.Stmt
+	// PrefixStatementsForClosure is like PrefixStatements but for a function literal
+	// launched via go/defer that closes over parentCtxIdent, the in-scope context
+	// identifier of the enclosing function. Backends typically derive the child span
+	// from that identifier rather than receiving ctx as a parameter.
+	PrefixStatementsForClosure(spanName, parentCtxIdent string, hasError bool) []ast.Stmt
+	// AttributeStatements builds the statements that call span.SetAttributes (or the
+	// backend's equivalent) for captures, against the span bound to spanVar by
+	// PrefixStatements. Captures with Kind "result" typically need wrapping in a
+	// defer so they observe the function's return values.
+	AttributeStatements(spanVar string, captures []Capture) []ast.Stmt
+	// OwnedImports lists the import paths this Instrumenter's statements depend on.
+	// ModeRemove uses it to decide which imports can be dropped once every marked
+	// block referencing them has been stripped.
+	OwnedImports() []string
 }
 
 // FunctionSelector tells if function has to be instrumented.
@@ -19,6 +39,84 @@ type FunctionSelector interface {
 	AcceptFunction(functionName string) bool
 }
 
+// directivePrefix is the pragma prefix recognised inside a function's doc comment,
+// e.g. "//instrument:skip".
+const directivePrefix = "instrument:"
+
+// directives holds the per-function overrides parsed from //instrument:* comment pragmas.
+type directives struct {
+	skip         bool
+	name         string
+	attrs        map[string]string
+	recordErrors *bool
+}
+
+// parseDirectives scans the comment groups associated with a function declaration for
+// //instrument:* pragmas and returns the overrides they describe.
+func parseDirectives(groups []*ast.CommentGroup) directives {
+	var d directives
+
+	for _, group := range groups {
+		if group == nil {
+			continue
+		}
+		for _, c := range group.List {
+			text := strings.TrimSpace(strings.TrimPrefix(c.Text, "//"))
+			if !strings.HasPrefix(text, directivePrefix) {
+				continue
+			}
+			text = strings.TrimPrefix(text, directivePrefix)
+
+			switch {
+			case text == "skip":
+				d.skip = true
+			case strings.HasPrefix(text, "name="):
+				d.name = strings.Trim(strings.TrimPrefix(text, "name="), `"`)
+			case strings.HasPrefix(text, "attr "):
+				kv := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(text, "attr ")), "=", 2)
+				if len(kv) == 2 {
+					if d.attrs == nil {
+						d.attrs = make(map[string]string)
+					}
+					d.attrs[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+				}
+			case strings.HasPrefix(text, "record-errors="):
+				v := strings.TrimPrefix(text, "record-errors=") == "true"
+				d.recordErrors = &v
+			}
+		}
+	}
+
+	return d
+}
+
+// DirectiveSelector wraps another FunctionSelector and lets a function's own
+// //instrument:skip comment pragma opt it out of instrumentation, without requiring
+// a central config change. Process populates the skip set as it walks each file.
+type DirectiveSelector struct {
+	FunctionSelector
+	skip map[string]bool
+}
+
+// NewDirectiveSelector wraps next so that //instrument:skip pragmas take precedence
+// over it.
+func NewDirectiveSelector(next FunctionSelector) *DirectiveSelector {
+	return &DirectiveSelector{FunctionSelector: next, skip: map[string]bool{}}
+}
+
+func (d *DirectiveSelector) AcceptFunction(functionName string) bool {
+	if d.skip[functionName] {
+		return false
+	}
+	return d.FunctionSelector.AcceptFunction(functionName)
+}
+
+// markSkip records whether functionName carried an //instrument:skip pragma. Process
+// calls this before AcceptFunction so the skip directive can veto the wrapped selector.
+func (d *DirectiveSelector) markSkip(functionName string, skip bool) {
+	d.skip[functionName] = skip
+}
+
 func ExtendedSpanName(name ...string) string {
 	if len(name) == 0 {
 		return ""
@@ -45,6 +143,344 @@ type Processor struct {
 	ContextType      string
 	ErrorName        string
 	ErrorType        string
+	// SpanVarName is the identifier the Instrumenter's prefix statements bind the span
+	// to (e.g. "span"). It is only consulted when Attributes captures are configured.
+	// Defaults to "span" when empty.
+	SpanVarName string
+	// Attributes, when set, causes Process to additionally emit span attribute calls
+	// for the named parameters and/or named results of each instrumented function.
+	Attributes AttributeCapture
+	// IncludeTypeParams includes a generic method receiver's instantiated type
+	// parameter names in the span suffix, e.g. "Repo[T].Find" instead of "Repo.Find".
+	IncludeTypeParams bool
+	// BuildContext, when set, causes Process to skip files whose //go:build or
+	// // +build constraints wouldn't compile under this context's GOOS, GOARCH, and
+	// BuildTags, so instrumentation isn't injected into code for a different target.
+	BuildContext *build.Context
+	// Include, when non-empty, restricts processing to files whose path matches at
+	// least one of these filepath.Match patterns.
+	Include []string
+	// Exclude skips files whose path matches any of these filepath.Match patterns,
+	// e.g. "*_test.go" or generated files. Exclude takes precedence over Include.
+	Exclude []string
+	// Mode selects how Process treats functions it has already instrumented.
+	// Defaults to ModeAdd.
+	Mode Mode
+}
+
+// Mode selects how Process treats a function that already carries a go-instrument
+// marker from a previous run.
+type Mode int
+
+const (
+	// ModeAdd instruments functions that aren't already marked, leaves marked ones
+	// whose recorded hash matches the current config untouched, and re-emits marked
+	// ones whose hash differs. The default; safe to run repeatedly, e.g. in CI on every commit.
+	ModeAdd Mode = iota
+	// ModeReplace strips a function's previously injected block and re-emits it from
+	// the current Instrumenter and config.
+	ModeReplace
+	// ModeRemove strips previously injected blocks without re-emitting them, and
+	// drops any Instrumenter.OwnedImports no longer referenced anywhere in the file.
+	ModeRemove
+)
+
+// markerBegin tags the comment Process attaches to the top of a function body it has
+// injected statements into, so later runs can detect, replace, or remove them.
+const markerBegin = "go-instrument:begin"
+
+// markerHash fingerprints the config that produced an instrumented block — span
+// name, error-capture flag, instrument:attr values, attribute-capture config, and
+// which Instrumenter backend is in use — so a later run can tell whether its
+// current config would produce the same block. Two configs that would emit
+// different statements must never hash the same, or ModeAdd will leave a stale
+// block in place believing it's still current.
+func markerHash(spanName string, hasError bool, attrs map[string]string, captures []Capture, backend Instrumenter) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(spanName))
+	if hasError {
+		_, _ = h.Write([]byte{1})
+	}
+	_, _ = h.Write([]byte(fmt.Sprintf("%T", backend)))
+
+	attrKeys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		attrKeys = append(attrKeys, k)
+	}
+	sort.Strings(attrKeys)
+	for _, k := range attrKeys {
+		_, _ = h.Write([]byte(k))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(attrs[k]))
+		_, _ = h.Write([]byte{0})
+	}
+
+	for _, c := range captures {
+		_, _ = h.Write([]byte(c.Name))
+		_, _ = h.Write([]byte(c.Kind))
+		_, _ = h.Write([]byte(c.Type))
+		if c.Redact {
+			_, _ = h.Write([]byte{1})
+		}
+		_, _ = h.Write([]byte(strconv.Itoa(c.MaxStringLen)))
+		_, _ = h.Write([]byte{0})
+	}
+
+	return fmt.Sprintf("%x", h.Sum32())
+}
+
+// findInstrumentedBlock looks for a go-instrument:begin marker inside body and
+// returns the hash and statement count it recorded, and whether one was found. The
+// count is how many statements, starting at the top of body.List, Process injected
+// on the run that wrote the marker — it, not comment positions, is what lets
+// stripInstrumentedBlock remove exactly those statements and nothing else.
+func (p *Processor) findInstrumentedBlock(file *ast.File, body *ast.BlockStmt) (hash string, count int, ok bool) {
+	if body == nil {
+		return "", 0, false
+	}
+
+	// Markers inside function literals nested in body belong to those closures.
+	var nested []*ast.BlockStmt
+	ast.Inspect(body, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.FuncLit); ok && lit.Body != nil {
+			nested = append(nested, lit.Body)
+		}
+		return true
+	})
+
+comments:
+	for _, cg := range file.Comments {
+		if cg == nil || cg.Pos() < body.Lbrace || cg.Pos() > body.Rbrace {
+			continue
+		}
+		for _, b := range nested {
+			if cg.Pos() >= b.Lbrace && cg.Pos() <= b.Rbrace {
+				continue comments
+			}
+		}
+
+		for _, c := range cg.List {
+			text := strings.TrimSpace(strings.TrimPrefix(c.Text, "//"))
+			if !strings.HasPrefix(text, markerBegin+" ") {
+				continue
+			}
+
+			fields := strings.Fields(strings.TrimPrefix(text, markerBegin+" "))
+			if len(fields) != 2 || !strings.HasPrefix(fields[1], "n=") {
+				continue
+			}
+
+			n, err := strconv.Atoi(strings.TrimPrefix(fields[1], "n="))
+			if err != nil {
+				continue
+			}
+
+			hash, count, ok = fields[0], n, true
+		}
+	}
+
+	return hash, count, ok
+}
+
+// stripInstrumentedBlock removes the first count statements of body — the block a
+// previous Process run injected at the top of the function or closure.
+func stripInstrumentedBlock(body *ast.BlockStmt, count int) {
+	if body == nil || count <= 0 || count > len(body.List) {
+		return
+	}
+	body.List = body.List[count:]
+}
+
+// recordMarker appends the comment marking the count statements Process just
+// injected at the top of body, so a later run can find and, if needed, strip them.
+func recordMarker(file *ast.File, body *ast.BlockStmt, hash string, count int) {
+	if body == nil || count == 0 {
+		return
+	}
+
+	file.Comments = append(file.Comments, &ast.CommentGroup{
+		List: []*ast.Comment{{Slash: body.Lbrace + 1, Text: fmt.Sprintf("// %s %s n=%d", markerBegin, hash, count)}},
+	})
+}
+
+// identUsed reports whether name appears as an identifier anywhere in file.
+func identUsed(file *ast.File, name string) bool {
+	used := false
+	ast.Inspect(file, func(n ast.Node) bool {
+		if used {
+			return false
+		}
+		if id, ok := n.(*ast.Ident); ok && id.Name == name {
+			used = true
+			return false
+		}
+		return true
+	})
+
+	return used
+}
+
+// importIdent returns the identifier a plain (unaliased) import of path is referenced
+// by in code, assumed from its last path segment with a leading "go-" and anything
+// from the first '-' or '.' dropped (e.g. "opentracing-go" gives "opentracing"). A
+// package whose name differs from its path in any other way is not recognised.
+func importIdent(path string) string {
+	name := strings.TrimPrefix(path[strings.LastIndex(path, "/")+1:], "go-")
+	if i := strings.IndexAny(name, "-."); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// removeUnusedOwnedImports drops any of the Instrumenter's owned imports that are no
+// longer referenced, for use after ModeRemove has stripped every marked block.
+func (p *Processor) removeUnusedOwnedImports(fset *token.FileSet, file *ast.File) {
+	for _, imp := range p.Instrumenter.OwnedImports() {
+		if identUsed(file, importIdent(imp)) {
+			continue
+		}
+		astutil.DeleteImport(fset, file, imp)
+	}
+}
+
+// matchesAny reports whether filename matches any of patterns, via matchesPath.
+func matchesAny(patterns []string, filename string) (bool, error) {
+	for _, pattern := range patterns {
+		ok, err := matchesPath(pattern, filename)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// matchesPath reports whether pattern matches filename, trying the full slash-
+// normalized path first and then progressively shorter path suffixes (ending with
+// the base name alone). This lets a directory-shaped pattern like "vendor/*" match,
+// which a basename-only filepath.Match never could, while still matching plain
+// basename patterns like "*_test.go".
+func matchesPath(pattern, filename string) (bool, error) {
+	path := filepath.ToSlash(filename)
+
+	for path != "" {
+		ok, err := filepath.Match(pattern, path)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+
+		idx := strings.Index(path, "/")
+		if idx == -1 {
+			break
+		}
+		path = path[idx+1:]
+	}
+
+	return false, nil
+}
+
+// shouldProcessFile reports whether filename should be walked, given BuildContext and
+// the Include/Exclude patterns. An empty filename (e.g. when Process is called
+// directly against an in-memory *ast.File) always passes.
+func (p *Processor) shouldProcessFile(filename string) (bool, error) {
+	if filename == "" {
+		return true, nil
+	}
+
+	excluded, err := matchesAny(p.Exclude, filename)
+	if err != nil {
+		return false, err
+	}
+	if excluded {
+		return false, nil
+	}
+
+	if len(p.Include) > 0 {
+		included, err := matchesAny(p.Include, filename)
+		if err != nil {
+			return false, err
+		}
+		if !included {
+			return false, nil
+		}
+	}
+
+	if p.BuildContext != nil {
+		dir, base := filepath.Split(filename)
+		if dir == "" {
+			dir = "."
+		}
+
+		ok, err := p.BuildContext.MatchFile(dir, base)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// AttributeCapture configures which parameters and named results Process should
+// surface as span attributes, in addition to the Instrumenter's own prefix statements.
+type AttributeCapture struct {
+	// Params lists parameter names to capture as span attributes.
+	Params []string
+	// Results lists named result identifiers to capture as span attributes on exit.
+	// If the corresponding result is unnamed, Process names it to make it capturable.
+	Results []string
+	// MaxStringLen truncates a string-kind capture's value to this many bytes.
+	// Zero means unlimited. Numeric-kind captures are never truncated; other kinds
+	// are rendered via fmt.Sprintf("%v", v) and are not truncated either.
+	MaxStringLen int
+	// Redact lists parameter/result names whose value should never be captured; these
+	// emit a "<redacted>" literal instead of the real value.
+	Redact []string
+}
+
+// Capture describes a single parameter or named result to surface as a span
+// attribute, and carries the per-name config (kind, type, redaction, truncation) an
+// Instrumenter needs to build the right attribute call.
+type Capture struct {
+	Name string
+	Kind string // "param" or "result"
+	// Type classifies the capture's declared Go type as "string", "numeric", or
+	// "other", inferred from the AST at capture time. Backends use this to pass
+	// string and numeric values through to their attribute API as-is and fall back
+	// to fmt.Sprintf("%v", v) for everything else (structs, pointers, interfaces,
+	// slices, maps, ...).
+	Type         string
+	Redact       bool
+	MaxStringLen int
+}
+
+// captureType classifies typ as "string", "numeric", or "other" so backends can
+// decide whether a capture's value can be passed through to their attribute API
+// as-is or needs to be rendered with fmt.Sprintf first.
+func captureType(typ ast.Expr) string {
+	id, ok := typ.(*ast.Ident)
+	if !ok || id == nil {
+		return "other"
+	}
+
+	switch id.Name {
+	case "string":
+		return "string"
+	case "int", "int8", "int16", "int32", "int64",
+		"uint", "uint8", "uint16", "uint32", "uint64", "uintptr",
+		"float32", "float64":
+		return "numeric"
+	default:
+		return "other"
+	}
 }
 
 func (p *Processor) methodReceiverTypeName(spec ast.FuncDecl) string {
@@ -62,14 +498,49 @@ func (p *Processor) methodReceiverTypeName(spec ast.FuncDecl) string {
 		if v, ok := v.Type.(*ast.StarExpr); ok {
 			t = v.X
 		}
-		// value/pointer receiver
-		if v, ok := t.(*ast.Ident); ok {
-			return v.Name
+
+		switch e := t.(type) {
+		case *ast.Ident:
+			// value/pointer receiver
+			return e.Name
+		case *ast.IndexExpr:
+			// generic receiver with a single type parameter, e.g. Repo[T]
+			return p.genericReceiverName(e.X, []ast.Expr{e.Index})
+		case *ast.IndexListExpr:
+			// generic receiver with multiple type parameters, e.g. Repo[K, V]
+			return p.genericReceiverName(e.X, e.Indices)
 		}
 	}
 	return ""
 }
 
+// genericReceiverName returns the base type name of a generic receiver such as
+// Repo[T] and, when Processor.IncludeTypeParams is set, appends its instantiated
+// type parameter names (e.g. "Repo[T]") so they show up in the span suffix.
+func (p *Processor) genericReceiverName(x ast.Expr, typeParams []ast.Expr) string {
+	id, ok := x.(*ast.Ident)
+	if !ok || id == nil {
+		return ""
+	}
+
+	if !p.IncludeTypeParams {
+		return id.Name
+	}
+
+	names := make([]string, 0, len(typeParams))
+	for _, tp := range typeParams {
+		if tid, ok := tp.(*ast.Ident); ok && tid != nil {
+			names = append(names, tid.Name)
+		}
+	}
+
+	if len(names) == 0 {
+		return id.Name
+	}
+
+	return fmt.Sprintf("%s[%s]", id.Name, strings.Join(names, ", "))
+}
+
 func (p *Processor) packageName(c *astutil.Cursor) string {
 	if c.Node() != nil || c.Name() != "Doc" {
 		return ""
@@ -115,6 +586,228 @@ func (p *Processor) isContext(e ast.Field) bool {
 	return pkg == p.ContextPackage && sym == p.ContextType
 }
 
+// funcScope tracks, for the function or function literal currently being walked, the
+// state a nested `go`/`defer` launched closure needs in order to be instrumented: the
+// enclosing *ast.FuncDecl (nil while inside a nested FuncLit), the name of the
+// in-scope context identifier (empty if none is visible), and the shared counter used
+// to number sibling closures func1, func2, ...
+type funcScope struct {
+	decl       *ast.FuncDecl
+	ctxIdent   string
+	closureSeq *int
+}
+
+// contextIdentName returns p.ContextName if t declares a parameter of that name and
+// type, or "" otherwise.
+func (p *Processor) contextIdentName(t *ast.FuncType) string {
+	if t == nil || t.Params == nil {
+		return ""
+	}
+	for _, q := range t.Params.List {
+		if q == nil {
+			continue
+		}
+		if p.isContext(*q) {
+			return p.ContextName
+		}
+	}
+	return ""
+}
+
+// assignsContext reports whether stmt assigns to an identifier named p.ContextName,
+// e.g. `ctx, cancel := context.WithCancel(ctx)`.
+func (p *Processor) assignsContext(stmt *ast.AssignStmt) bool {
+	if stmt == nil {
+		return false
+	}
+	for _, lhs := range stmt.Lhs {
+		if id, ok := lhs.(*ast.Ident); ok && id != nil && id.Name == p.ContextName {
+			return true
+		}
+	}
+	return false
+}
+
+// nearestDecl returns the closest enclosing *ast.FuncDecl on the scope stack, walking
+// outwards past any intervening function literals.
+func nearestDecl(stack []*funcScope) *ast.FuncDecl {
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i].decl != nil {
+			return stack[i].decl
+		}
+	}
+	return nil
+}
+
+// instrumentClosure checks whether call is a `go`/`defer`-launched function literal
+// that closes over an in-scope context, and if so appends the patch that injects its
+// span prefix statements. Like FuncDecl bodies, the closure's body gets a begin
+// marker so repeat Process runs detect, replace, or remove it instead of stacking a
+// second set of prefix statements on top of the first.
+func (p *Processor) instrumentClosure(file *ast.File, call *ast.CallExpr, stack []*funcScope, packageName string, patches *[]patch) {
+	if call == nil || len(stack) == 0 {
+		return
+	}
+	lit, ok := call.Fun.(*ast.FuncLit)
+	if !ok || lit == nil || lit.Body == nil {
+		return
+	}
+
+	scope := stack[len(stack)-1]
+	if scope.ctxIdent == "" {
+		return
+	}
+
+	decl := nearestDecl(stack)
+	if decl == nil {
+		return
+	}
+
+	hasError := false
+	if t := lit.Type; t != nil && t.Results != nil {
+		for _, q := range t.Results.List {
+			if q == nil {
+				continue
+			}
+			hasError = hasError || p.isError(*q)
+		}
+	}
+
+	*scope.closureSeq++
+	spanName := p.SpanName(packageName, p.methodReceiverTypeName(*decl), p.functionName(*decl))
+	spanName = ExtendedSpanName(spanName, fmt.Sprintf("func%d", *scope.closureSeq))
+
+	currentHash := markerHash(spanName, hasError, nil, nil, p.Instrumenter)
+	recordedHash, count, marked := p.findInstrumentedBlock(file, lit.Body)
+
+	if marked && (p.Mode == ModeRemove || p.Mode == ModeReplace || recordedHash != currentHash) {
+		stripInstrumentedBlock(lit.Body, count)
+		marked = false
+	}
+
+	if p.Mode == ModeRemove || marked {
+		return
+	}
+
+	ps := p.Instrumenter.PrefixStatementsForClosure(spanName, scope.ctxIdent, hasError)
+	*patches = append(*patches, patch{pos: lit.Body.Pos(), stmts: ps})
+	recordMarker(file, lit.Body, currentHash, len(ps))
+}
+
+// paramCaptures returns a Capture for each parameter of fn whose name is listed in
+// p.Attributes.Params.
+func (p *Processor) paramCaptures(fn *ast.FuncDecl) []Capture {
+	if len(p.Attributes.Params) == 0 || fn.Type.Params == nil {
+		return nil
+	}
+
+	want := make(map[string]bool, len(p.Attributes.Params))
+	for _, n := range p.Attributes.Params {
+		want[n] = true
+	}
+
+	var captures []Capture
+	for _, field := range fn.Type.Params.List {
+		for _, id := range field.Names {
+			if id != nil && want[id.Name] {
+				captures = append(captures, p.newCapture(id.Name, "param", field.Type))
+			}
+		}
+	}
+
+	return captures
+}
+
+// resultCaptures returns a Capture for each result of fn whose name is listed in
+// p.Attributes.Results, naming any unnamed result slot so it becomes addressable
+// from the exit-time defer AttributeStatements builds.
+func (p *Processor) resultCaptures(fn *ast.FuncDecl) []Capture {
+	names := p.Attributes.Results
+	if len(names) == 0 || fn.Type.Results == nil {
+		return nil
+	}
+
+	want := make(map[string]bool, len(names))
+	for _, n := range names {
+		want[n] = true
+	}
+
+	p.nameUnnamedResults(fn, names)
+
+	var captures []Capture
+	for _, field := range fn.Type.Results.List {
+		for _, id := range field.Names {
+			if id != nil && want[id.Name] {
+				captures = append(captures, p.newCapture(id.Name, "result", field.Type))
+			}
+		}
+	}
+
+	return captures
+}
+
+// nameUnnamedResults assigns names from p.Attributes.Results to fn's unnamed result
+// fields. An entry equal to p.ErrorName is bound to the first unnamed field whose
+// type is p.ErrorType, wherever that field falls positionally — "tag the error
+// result" is by far the most common use of this list (e.g. func(ctx) (string,
+// error) with Results: []string{"err"}), and binding it by declaration order alone
+// would instead name the unnamed string result "err" and leave the real error
+// uncaptured. Remaining entries are assigned to the remaining unnamed fields in
+// declaration order, and any field still unnamed after that is named "_", since Go
+// does not allow named and unnamed results in one list.
+func (p *Processor) nameUnnamedResults(fn *ast.FuncDecl, names []string) {
+	remaining := make([]string, 0, len(names))
+	for _, n := range names {
+		if n == p.ErrorName {
+			if field := p.unnamedErrorResult(fn); field != nil {
+				field.Names = []*ast.Ident{ast.NewIdent(n)}
+				continue
+			}
+		}
+		remaining = append(remaining, n)
+	}
+
+	idx := 0
+	for _, field := range fn.Type.Results.List {
+		if len(field.Names) > 0 {
+			continue
+		}
+		name := "_"
+		if idx < len(remaining) {
+			name = remaining[idx]
+			idx++
+		}
+		field.Names = []*ast.Ident{ast.NewIdent(name)}
+	}
+}
+
+// unnamedErrorResult returns fn's first unnamed result field whose type is
+// p.ErrorType, or nil if there isn't one.
+func (p *Processor) unnamedErrorResult(fn *ast.FuncDecl) *ast.Field {
+	for _, field := range fn.Type.Results.List {
+		if len(field.Names) > 0 {
+			continue
+		}
+		if v, ok := field.Type.(*ast.Ident); ok && v != nil && v.Name == p.ErrorType {
+			return field
+		}
+	}
+
+	return nil
+}
+
+func (p *Processor) newCapture(name, kind string, typ ast.Expr) Capture {
+	c := Capture{Name: name, Kind: kind, Type: captureType(typ), MaxStringLen: p.Attributes.MaxStringLen}
+	for _, r := range p.Attributes.Redact {
+		if r == name {
+			c.Redact = true
+			break
+		}
+	}
+
+	return c
+}
+
 func (p *Processor) isError(e ast.Field) bool {
 	// anonymous arg
 	// multilple symbols
@@ -134,10 +827,50 @@ func (p *Processor) isError(e ast.Field) bool {
 }
 
 func (p *Processor) Process(fset *token.FileSet, file *ast.File) error {
+	if ok, err := p.shouldProcessFile(fset.Position(file.Pos()).Filename); err != nil || !ok {
+		return err
+	}
+
 	var packageName string
 	var patches []patch
+	var stack []*funcScope
+
+	cmap := ast.NewCommentMap(fset, file, file.Comments)
+
+	pre := func(c *astutil.Cursor) bool {
+		if c == nil {
+			return true
+		}
+
+		switch n := c.Node().(type) {
+		case *ast.FuncDecl:
+			seq := 0
+			stack = append(stack, &funcScope{decl: n, ctxIdent: p.contextIdentName(n.Type), closureSeq: &seq})
+		case *ast.FuncLit:
+			ctxIdent := p.contextIdentName(n.Type)
+			var closureSeq *int
+			if len(stack) > 0 {
+				top := stack[len(stack)-1]
+				if ctxIdent == "" {
+					ctxIdent = top.ctxIdent
+				}
+				closureSeq = top.closureSeq
+			}
+			if closureSeq == nil {
+				seq := 0
+				closureSeq = &seq
+			}
+			stack = append(stack, &funcScope{ctxIdent: ctxIdent, closureSeq: closureSeq})
+		case *ast.AssignStmt:
+			if len(stack) > 0 && p.assignsContext(n) {
+				stack[len(stack)-1].ctxIdent = p.ContextName
+			}
+		}
 
-	astutil.Apply(file, nil, func(c *astutil.Cursor) bool {
+		return true
+	}
+
+	post := func(c *astutil.Cursor) bool {
 		if c == nil {
 			return true
 		}
@@ -145,12 +878,29 @@ func (p *Processor) Process(fset *token.FileSet, file *ast.File) error {
 			packageName = p.packageName(c)
 		}
 
+		switch n := c.Node().(type) {
+		case *ast.FuncDecl, *ast.FuncLit:
+			stack = stack[:len(stack)-1]
+		case *ast.GoStmt:
+			p.instrumentClosure(file, n.Call, stack, packageName, &patches)
+			return true
+		case *ast.DeferStmt:
+			p.instrumentClosure(file, n.Call, stack, packageName, &patches)
+			return true
+		}
+
 		fn, ok := c.Node().(*ast.FuncDecl)
 		if !ok || fn == nil {
 			return true
 		}
 
 		fname := p.functionName(*fn)
+		dir := parseDirectives(cmap[fn])
+
+		if ds, ok := p.FunctionSelector.(*DirectiveSelector); ok {
+			ds.markSkip(fname, dir.skip)
+		}
+
 		if !p.FunctionSelector.AcceptFunction(fname) {
 			return true
 		}
@@ -183,11 +933,56 @@ func (p *Processor) Process(fset *token.FileSet, file *ast.File) error {
 		}
 
 		spanName := p.SpanName(packageName, p.methodReceiverTypeName(*fn), fname)
-		ps := p.Instrumenter.PrefixStatements(spanName, hasError)
+		if dir.name != "" {
+			spanName = dir.name
+		}
+		if dir.recordErrors != nil && !*dir.recordErrors {
+			hasError = false
+		}
+
+		captures := append(p.paramCaptures(fn), p.resultCaptures(fn)...)
+
+		currentHash := markerHash(spanName, hasError, dir.attrs, captures, p.Instrumenter)
+		recordedHash, count, marked := p.findInstrumentedBlock(file, fn.Body)
+
+		// Strip the existing block outright for ModeRemove/ModeReplace, and also for
+		// ModeAdd when the recorded hash shows the config has changed since it was
+		// written — otherwise ModeAdd would silently keep a stale block around.
+		if marked && (p.Mode == ModeRemove || p.Mode == ModeReplace || recordedHash != currentHash) {
+			stripInstrumentedBlock(fn.Body, count)
+			marked = false
+		}
+
+		if p.Mode == ModeRemove {
+			return true
+		}
+
+		if marked {
+			// Same config as the block already in place; ModeAdd is idempotent.
+			return true
+		}
+
+		ps := p.Instrumenter.PrefixStatements(spanName, hasError, dir.attrs)
+
+		if len(captures) > 0 {
+			spanVar := p.SpanVarName
+			if spanVar == "" {
+				spanVar = "span"
+			}
+			ps = append(ps, p.Instrumenter.AttributeStatements(spanVar, captures)...)
+		}
+
 		patches = append(patches, patch{pos: fn.Body.Pos(), stmts: ps})
+		recordMarker(file, fn.Body, currentHash, len(ps))
 
 		return true
-	})
+	}
+
+	astutil.Apply(file, pre, post)
+
+	if p.Mode == ModeRemove {
+		p.removeUnusedOwnedImports(fset, file)
+	}
 
 	if len(patches) > 0 {
 		if err := p.patchFile(fset, file, patches...); err != nil {
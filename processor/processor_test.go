@@ -0,0 +1,231 @@
+package processor
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+// parseFuncDecl parses src as a complete file and returns its first *ast.FuncDecl,
+// so tests can exercise methodReceiverTypeName against real, positioned AST nodes
+// instead of hand-built ones.
+func parseFuncDecl(t *testing.T, src string) *ast.FuncDecl {
+	t.Helper()
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			return fn
+		}
+	}
+
+	t.Fatalf("no func decl found in source")
+	return nil
+}
+
+func TestMethodReceiverTypeName(t *testing.T) {
+	tests := []struct {
+		name              string
+		src               string
+		includeTypeParams bool
+		want              string
+	}{
+		{
+			name: "function, no receiver",
+			src:  "package p\nfunc Foo() {}",
+			want: "",
+		},
+		{
+			name: "value receiver",
+			src:  "package p\ntype Repo struct{}\nfunc (r Repo) Foo() {}",
+			want: "Repo",
+		},
+		{
+			name: "pointer receiver",
+			src:  "package p\ntype Repo struct{}\nfunc (r *Repo) Foo() {}",
+			want: "Repo",
+		},
+		{
+			name: "single type param, IncludeTypeParams false",
+			src:  "package p\ntype Repo[T any] struct{}\nfunc (r Repo[T]) Foo() {}",
+			want: "Repo",
+		},
+		{
+			name:              "single type param, IncludeTypeParams true",
+			src:               "package p\ntype Repo[T any] struct{}\nfunc (r Repo[T]) Foo() {}",
+			includeTypeParams: true,
+			want:              "Repo[T]",
+		},
+		{
+			name:              "multiple type params, IncludeTypeParams true",
+			src:               "package p\ntype Repo[K comparable, V any] struct{}\nfunc (r Repo[K, V]) Foo() {}",
+			includeTypeParams: true,
+			want:              "Repo[K, V]",
+		},
+		{
+			name:              "pointer receiver with type params, IncludeTypeParams true",
+			src:               "package p\ntype Repo[T any] struct{}\nfunc (r *Repo[T]) Foo() {}",
+			includeTypeParams: true,
+			want:              "Repo[T]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := parseFuncDecl(t, tt.src)
+			p := &Processor{IncludeTypeParams: tt.includeTypeParams}
+
+			got := p.methodReceiverTypeName(*fn)
+			if got != tt.want {
+				t.Errorf("methodReceiverTypeName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResultCaptures(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		results []string
+		want    map[string]string // capture name -> Type
+	}{
+		{
+			name:    "unnamed string and error results, capturing only err",
+			src:     "package p\nimport \"context\"\nfunc Foo(ctx context.Context) (string, error) { return \"\", nil }",
+			results: []string{"err"},
+			want:    map[string]string{"err": "other"},
+		},
+		{
+			name:    "unnamed string and error results, capturing both",
+			src:     "package p\nimport \"context\"\nfunc Foo(ctx context.Context) (string, error) { return \"\", nil }",
+			results: []string{"err", "out"},
+			want:    map[string]string{"err": "other", "out": "string"},
+		},
+		{
+			name:    "already-named results are captured as-is",
+			src:     "package p\nimport \"context\"\nfunc Foo(ctx context.Context) (out int, err error) { return 0, nil }",
+			results: []string{"err", "out"},
+			want:    map[string]string{"err": "other", "out": "numeric"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := parseFuncDecl(t, tt.src)
+			p := &Processor{
+				ErrorName:  "err",
+				ErrorType:  "error",
+				Attributes: AttributeCapture{Results: tt.results},
+			}
+
+			captures := p.resultCaptures(fn)
+			if len(captures) != len(tt.want) {
+				t.Fatalf("resultCaptures() = %v, want %d captures matching %v", captures, len(tt.want), tt.want)
+			}
+
+			for _, c := range captures {
+				wantType, ok := tt.want[c.Name]
+				if !ok {
+					t.Errorf("unexpected capture %q", c.Name)
+					continue
+				}
+				if c.Name == "err" && c.Type != "other" {
+					t.Errorf("capture %q bound to a non-error result (Type = %q)", c.Name, c.Type)
+				}
+				if c.Type != wantType {
+					t.Errorf("capture %q Type = %q, want %q", c.Name, c.Type, wantType)
+				}
+			}
+		})
+	}
+}
+
+// fakeBackendA and fakeBackendB are two distinct Instrumenter implementations used
+// only to give markerHash two different backend identities to distinguish.
+type fakeBackendA struct{}
+
+func (fakeBackendA) Imports() []string { return nil }
+func (fakeBackendA) PrefixStatements(string, bool, map[string]string) []ast.Stmt { return nil }
+func (fakeBackendA) PrefixStatementsForClosure(string, string, bool) []ast.Stmt { return nil }
+func (fakeBackendA) AttributeStatements(string, []Capture) []ast.Stmt { return nil }
+func (fakeBackendA) OwnedImports() []string { return nil }
+
+type fakeBackendB struct{}
+
+func (fakeBackendB) Imports() []string { return nil }
+func (fakeBackendB) PrefixStatements(string, bool, map[string]string) []ast.Stmt { return nil }
+func (fakeBackendB) PrefixStatementsForClosure(string, string, bool) []ast.Stmt { return nil }
+func (fakeBackendB) AttributeStatements(string, []Capture) []ast.Stmt { return nil }
+func (fakeBackendB) OwnedImports() []string { return nil }
+
+func TestMarkerHashDistinguishesConfig(t *testing.T) {
+	base := markerHash("span", false, nil, nil, fakeBackendA{})
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"different span name", markerHash("other", false, nil, nil, fakeBackendA{})},
+		{"different hasError", markerHash("span", true, nil, nil, fakeBackendA{})},
+		{"different attrs", markerHash("span", false, map[string]string{"env": "prod"}, nil, fakeBackendA{})},
+		{"different captures", markerHash("span", false, nil, []Capture{{Name: "x", Kind: "param"}}, fakeBackendA{})},
+		{"different backend", markerHash("span", false, nil, nil, fakeBackendB{})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.hash == base {
+				t.Errorf("markerHash() did not change for %s", tt.name)
+			}
+		})
+	}
+
+	t.Run("stable for identical config", func(t *testing.T) {
+		if got := markerHash("span", false, nil, nil, fakeBackendA{}); got != base {
+			t.Errorf("markerHash() = %q, want %q (same config)", got, base)
+		}
+	})
+
+	t.Run("attr key order does not matter", func(t *testing.T) {
+		a := markerHash("span", false, map[string]string{"env": "prod", "zone": "a"}, nil, fakeBackendA{})
+		b := markerHash("span", false, map[string]string{"zone": "a", "env": "prod"}, nil, fakeBackendA{})
+		if a != b {
+			t.Errorf("markerHash() depends on map iteration order: %q != %q", a, b)
+		}
+	})
+}
+
+func TestFindAndStripInstrumentedBlock(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", "package p\nfunc Foo() {\n\tx := 1\n\t_ = x\n}", parser.ParseComments)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	fn := f.Decls[0].(*ast.FuncDecl)
+	p := &Processor{}
+
+	if _, _, ok := p.findInstrumentedBlock(f, fn.Body); ok {
+		t.Fatalf("findInstrumentedBlock() found a marker before one was recorded")
+	}
+
+	recordMarker(f, fn.Body, "deadbeef", 1)
+
+	hash, count, ok := p.findInstrumentedBlock(f, fn.Body)
+	if !ok || hash != "deadbeef" || count != 1 {
+		t.Fatalf("findInstrumentedBlock() = (%q, %d, %v), want (\"deadbeef\", 1, true)", hash, count, ok)
+	}
+
+	want := len(fn.Body.List) - count
+	stripInstrumentedBlock(fn.Body, count)
+	if len(fn.Body.List) != want {
+		t.Fatalf("stripInstrumentedBlock() left %d statements, want %d", len(fn.Body.List), want)
+	}
+}
@@ -0,0 +1,28 @@
+package processor
+
+import "fmt"
+
+// InstrumenterFactory builds an Instrumenter from backend-specific configuration. cfg
+// is the raw key/value config for the backend (e.g. decoded from YAML/flags); it is up
+// to the factory to interpret it.
+type InstrumenterFactory func(cfg map[string]any) (Instrumenter, error)
+
+var instrumenters = map[string]InstrumenterFactory{}
+
+// RegisterInstrumenter makes an Instrumenter backend available under name for later
+// lookup via NewInstrumenter. Backend packages (e.g. processor/backends) call this
+// from an init function; registering the same name twice replaces the prior factory.
+func RegisterInstrumenter(name string, factory InstrumenterFactory) {
+	instrumenters[name] = factory
+}
+
+// NewInstrumenter builds the Instrumenter registered under name, passing it cfg. It
+// returns an error if no backend was registered under that name.
+func NewInstrumenter(name string, cfg map[string]any) (Instrumenter, error) {
+	factory, ok := instrumenters[name]
+	if !ok {
+		return nil, fmt.Errorf("processor: no instrumenter registered for %q", name)
+	}
+
+	return factory(cfg)
+}